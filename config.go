@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// HostConfig holds per-host overrides layered on top of the global
+// settings in Config, keyed by hostname in Config.Hosts.
+type HostConfig struct {
+	MaxPerHost int    `toml:"max_per_host"`
+	UserAgent  string `toml:"user_agent"`
+}
+
+// Config is loaded from ~/.config/newsb-dl/config.toml. Any field left
+// zero in the file falls back to the value from defaultConfig, so an
+// absent or partial file is always usable.
+type Config struct {
+	DestDir           string                `toml:"dest_dir"`
+	MaxPerHost        int                   `toml:"max_per_host"`
+	GlobalConcurrency int                   `toml:"global_concurrency"`
+	RequestTimeout    string                `toml:"request_timeout"`
+	DialTimeout       string                `toml:"dial_timeout"`
+	UserAgent         string                `toml:"user_agent"`
+	Retries           int                   `toml:"retries"`
+	QueuePath         string                `toml:"queue_path"`
+	Feeds             []string              `toml:"feeds"`
+	FeedsFile         string                `toml:"feeds_file"`
+	Hosts             map[string]HostConfig `toml:"hosts"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		MaxPerHost:        1,
+		GlobalConcurrency: 4,
+		RequestTimeout:    "20s",
+		DialTimeout:       "20s",
+		UserAgent:         "newsb-dl",
+		Retries:           defaultMaxAttempts,
+		Hosts:             map[string]HostConfig{},
+	}
+}
+
+func configPath() string {
+	return filepath.Join(newsbdlDir(), "config.toml")
+}
+
+// loadConfig reads the config file at path, falling back to defaultConfig for any
+// field the file doesn't set. A missing file is not an error.
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return &cfg, nil
+	}
+	if _, err := toml.DecodeFile(path, &cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Hosts == nil {
+		cfg.Hosts = map[string]HostConfig{}
+	}
+	if cfg.Retries < 1 {
+		cfg.Retries = defaultMaxAttempts
+	}
+	if cfg.MaxPerHost < 1 {
+		cfg.MaxPerHost = defaultConfig().MaxPerHost
+	}
+	if cfg.GlobalConcurrency < 1 {
+		cfg.GlobalConcurrency = defaultConfig().GlobalConcurrency
+	}
+	return &cfg, nil
+}
+
+func (cfg *Config) maxPerHost(host string) int {
+	if h, ok := cfg.Hosts[host]; ok && h.MaxPerHost > 0 {
+		return h.MaxPerHost
+	}
+	return cfg.MaxPerHost
+}
+
+func (cfg *Config) userAgent(host string) string {
+	if h, ok := cfg.Hosts[host]; ok && h.UserAgent != "" {
+		return h.UserAgent
+	}
+	return cfg.UserAgent
+}
+
+func (cfg *Config) requestTimeout() time.Duration {
+	d, err := time.ParseDuration(cfg.RequestTimeout)
+	if err != nil {
+		return 20 * time.Second
+	}
+	return d
+}
+
+func (cfg *Config) dialTimeout() time.Duration {
+	d, err := time.ParseDuration(cfg.DialTimeout)
+	if err != nil {
+		return 20 * time.Second
+	}
+	return d
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigClampsRetries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte("retries = 0\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.Retries != defaultMaxAttempts {
+		t.Errorf("Retries = %d, want a natural retries=0 to fall back to %d rather than never trying at all", cfg.Retries, defaultMaxAttempts)
+	}
+}
+
+func TestLoadConfigClampsConcurrency(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	toml := "max_per_host = 0\nglobal_concurrency = 0\n"
+	if err := os.WriteFile(path, []byte(toml), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	want := defaultConfig()
+	if cfg.MaxPerHost != want.MaxPerHost {
+		t.Errorf("MaxPerHost = %d, want a non-positive value to fall back to %d (0 would deadlock downloadByHost's semaphore)", cfg.MaxPerHost, want.MaxPerHost)
+	}
+	if cfg.GlobalConcurrency != want.GlobalConcurrency {
+		t.Errorf("GlobalConcurrency = %d, want a non-positive value to fall back to %d (0 would deadlock downloadAll's semaphore)", cfg.GlobalConcurrency, want.GlobalConcurrency)
+	}
+}
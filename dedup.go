@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aver-d/newsb-dl/internal/logging"
+)
+
+// extByContentType covers the handful of media types podcast hosts
+// actually serve; mime.TypeByExtension's reverse isn't reliable enough
+// across platforms to depend on for this.
+var extByContentType = map[string]string{
+	"audio/mpeg":       ".mp3",
+	"audio/mp4":        ".m4a",
+	"audio/x-m4a":      ".m4a",
+	"audio/ogg":        ".ogg",
+	"audio/wav":        ".wav",
+	"audio/x-wav":      ".wav",
+	"audio/aac":        ".aac",
+	"audio/flac":       ".flac",
+	"video/mp4":        ".mp4",
+	"video/quicktime":  ".mov",
+	"video/x-matroska": ".mkv",
+	"video/webm":       ".webm",
+}
+
+func extensionFor(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return extByContentType[strings.TrimSpace(contentType)]
+}
+
+func isMediaType(contentType string) bool {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.TrimSpace(contentType)
+	return strings.HasPrefix(contentType, "audio/") || strings.HasPrefix(contentType, "video/")
+}
+
+// sniffMediaType reads up to the first 512 bytes of r to classify it with
+// http.DetectContentType, returning a reader that still yields those bytes
+// to the caller.
+func sniffMediaType(r io.Reader) (contentType string, rest io.Reader, err error) {
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", nil, err
+	}
+	buf = buf[:n]
+	return http.DetectContentType(buf), io.MultiReader(bytes.NewReader(buf), r), nil
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// HashIndex is a persisted sha256(content) -> path map, so a file already
+// downloaded under a different name or from a different feed doesn't get
+// written out twice.
+type HashIndex struct {
+	mu    sync.Mutex
+	paths map[string]string
+	path  string
+}
+
+func hashesPath() string {
+	return filepath.Join(newsbdlDir(), "hashes")
+}
+
+func loadHashIndex(path string) (*HashIndex, error) {
+	idx := &HashIndex{paths: map[string]string{}, path: path}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		fields := strings.SplitN(scan.Text(), "\t", 2)
+		if len(fields) == 2 {
+			idx.paths[fields[0]] = fields[1]
+		}
+	}
+	return idx, scan.Err()
+}
+
+// lookup returns the path previously recorded for sum, forgetting it if
+// the file has since disappeared.
+func (idx *HashIndex) lookup(sum string) (string, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	path, ok := idx.paths[sum]
+	if ok {
+		if _, err := os.Stat(path); err != nil {
+			delete(idx.paths, sum)
+			return "", false
+		}
+	}
+	return path, ok
+}
+
+func (idx *HashIndex) record(sum, path string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.paths[sum] = path
+}
+
+func (idx *HashIndex) save() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	f, err := os.Create(idx.path)
+	if err != nil {
+		return err
+	}
+	for sum, path := range idx.paths {
+		fmt.Fprintf(f, "%s\t%s\n", sum, path)
+	}
+	return f.Close()
+}
+
+// claimName atomically reserves the first free name starting at base,
+// via O_CREATE|O_EXCL, and returns the open (empty) file along with the
+// path it claimed. The caller owns the file and must close it. Unlike a
+// Stat-then-act loop, this can't race another goroutine onto the same name.
+func claimName(base string) (*os.File, string, error) {
+	path := base
+	n := 1
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			return f, path, nil
+		}
+		if !os.IsExist(err) {
+			return nil, "", err
+		}
+		path = fmt.Sprintf("%s.%d", base, n)
+		n += 1
+	}
+}
+
+// linkUnique hardlinks existing onto the first free name starting at
+// base, retrying the next candidate name on a collision. os.Link itself
+// fails rather than overwriting when the destination exists, so each
+// attempt is atomic and safe against a concurrent download claiming the
+// same name.
+func linkUnique(existing, base string) (string, error) {
+	path := base
+	n := 1
+	for {
+		err := os.Link(existing, path)
+		if err == nil {
+			return path, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+		path = fmt.Sprintf("%s.%d", base, n)
+		n += 1
+	}
+}
+
+// finalizeDownload hashes the completed pathTemp and either hardlinks it
+// onto an already-downloaded file with the same content, or moves it into
+// place and records its hash for future dedup.
+func finalizeDownload(pathTemp, pathData string) error {
+	sum, err := sha256File(pathTemp)
+	if err != nil {
+		return err
+	}
+	if existing, ok := hashIndex.lookup(sum); ok {
+		path, err := linkUnique(existing, pathData)
+		if err != nil {
+			return err
+		}
+		logging.Info("fs", "deduplicated %s (matches %s)", path, existing)
+		return os.Remove(pathTemp)
+	}
+	final, err := renameUnique(pathTemp, pathData)
+	if err != nil {
+		return err
+	}
+	hashIndex.record(sum, final)
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtensionFor(t *testing.T) {
+	cases := []struct {
+		contentType string
+		want        string
+	}{
+		{"audio/mpeg", ".mp3"},
+		{"audio/mpeg; charset=binary", ".mp3"},
+		{"video/mp4", ".mp4"},
+		{"text/html", ""},
+		{"", ""},
+	}
+	for _, c := range cases {
+		if got := extensionFor(c.contentType); got != c.want {
+			t.Errorf("extensionFor(%q) = %q, want %q", c.contentType, got, c.want)
+		}
+	}
+}
+
+func TestIsMediaType(t *testing.T) {
+	cases := []struct {
+		contentType string
+		want        bool
+	}{
+		{"audio/mpeg", true},
+		{"video/mp4; codecs=avc1", true},
+		{"text/html", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		if got := isMediaType(c.contentType); got != c.want {
+			t.Errorf("isMediaType(%q) = %v, want %v", c.contentType, got, c.want)
+		}
+	}
+}
+
+func TestSniffMediaType(t *testing.T) {
+	// ID3-tagged MP3 header, enough for http.DetectContentType to
+	// recognize it as audio/mpeg.
+	mp3 := append([]byte("ID3\x03\x00\x00\x00\x00\x00\x00"), make([]byte, 600)...)
+	contentType, rest, err := sniffMediaType(strings.NewReader(string(mp3)))
+	if err != nil {
+		t.Fatalf("sniffMediaType: %v", err)
+	}
+	if !isMediaType(contentType) {
+		t.Errorf("sniffMediaType contentType = %q, want audio/*", contentType)
+	}
+	all, err := io.ReadAll(rest)
+	if err != nil {
+		t.Fatalf("reading rest: %v", err)
+	}
+	if len(all) != len(mp3) {
+		t.Errorf("rest yielded %d bytes, want all %d sniffed bytes preserved", len(all), len(mp3))
+	}
+
+	t.Run("short body", func(t *testing.T) {
+		contentType, rest, err := sniffMediaType(strings.NewReader("ID3 tiny"))
+		if err != nil {
+			t.Fatalf("sniffMediaType on a body shorter than the sniff window: %v", err)
+		}
+		all, err := io.ReadAll(rest)
+		if err != nil {
+			t.Fatalf("reading rest: %v", err)
+		}
+		if string(all) != "ID3 tiny" {
+			t.Errorf("rest = %q, want original bytes preserved", all)
+		}
+		_ = contentType
+	})
+}
+
+func TestFinalizeDownload(t *testing.T) {
+	dir := t.TempDir()
+	origHashIndex := hashIndex
+	defer func() { hashIndex = origHashIndex }()
+
+	write := func(path, content string) {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	t.Run("moves new content into place", func(t *testing.T) {
+		hashIndex = &HashIndex{paths: map[string]string{}}
+		temp := filepath.Join(dir, "a.part")
+		data := filepath.Join(dir, "a.mp3")
+		write(temp, "episode one")
+
+		if err := finalizeDownload(temp, data); err != nil {
+			t.Fatalf("finalizeDownload: %v", err)
+		}
+		if _, err := os.Stat(data); err != nil {
+			t.Errorf("final path missing: %v", err)
+		}
+		if _, err := os.Stat(temp); !os.IsNotExist(err) {
+			t.Errorf("temp path should be gone, stat err = %v", err)
+		}
+	})
+
+	t.Run("hardlinks a duplicate instead of rewriting it", func(t *testing.T) {
+		hashIndex = &HashIndex{paths: map[string]string{}}
+		existing := filepath.Join(dir, "existing.mp3")
+		write(existing, "same bytes")
+		sum, err := sha256File(existing)
+		if err != nil {
+			t.Fatalf("sha256File: %v", err)
+		}
+		hashIndex.record(sum, existing)
+
+		temp := filepath.Join(dir, "dup.part")
+		data := filepath.Join(dir, "dup.mp3")
+		write(temp, "same bytes")
+
+		if err := finalizeDownload(temp, data); err != nil {
+			t.Fatalf("finalizeDownload: %v", err)
+		}
+		if _, err := os.Stat(temp); !os.IsNotExist(err) {
+			t.Errorf("temp path should be removed after linking, stat err = %v", err)
+		}
+		existingInfo, err := os.Stat(existing)
+		if err != nil {
+			t.Fatalf("stat existing: %v", err)
+		}
+		dataInfo, err := os.Stat(data)
+		if err != nil {
+			t.Fatalf("stat data: %v", err)
+		}
+		if !os.SameFile(existingInfo, dataInfo) {
+			t.Errorf("expected %s to be hardlinked to %s", data, existing)
+		}
+	})
+
+	t.Run("renameUnique avoids clobbering an existing name", func(t *testing.T) {
+		base := filepath.Join(dir, "collide.mp3")
+		write(base, "first")
+		src := filepath.Join(dir, "collide.part")
+		write(src, "second")
+
+		final, err := renameUnique(src, base)
+		if err != nil {
+			t.Fatalf("renameUnique: %v", err)
+		}
+		if final == base {
+			t.Fatalf("renameUnique landed on the occupied name %s instead of a new one", base)
+		}
+		content, err := os.ReadFile(base)
+		if err != nil {
+			t.Fatalf("reading original: %v", err)
+		}
+		if string(content) != "first" {
+			t.Errorf("original file was clobbered: got %q", content)
+		}
+		content, err = os.ReadFile(final)
+		if err != nil {
+			t.Fatalf("reading %s: %v", final, err)
+		}
+		if string(content) != "second" {
+			t.Errorf("renamed file has wrong content: got %q", content)
+		}
+	})
+}
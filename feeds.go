@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+
+	"github.com/aver-d/newsb-dl/internal/logging"
+)
+
+// Feeds is a list of feed URLs to poll in -feeds mode.
+type Feeds []string
+
+// readFeedList reads one feed URL per line, ignoring blank lines and
+// lines starting with '#'.
+func readFeedList(path string) (Feeds, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var feeds Feeds
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		feeds = append(feeds, line)
+	}
+	return feeds, scan.Err()
+}
+
+// resolveFeeds combines the feed URLs given directly in the config with
+// any listed in cfg.FeedsFile.
+func resolveFeeds(cfg *Config) (Feeds, error) {
+	feeds := Feeds(cfg.Feeds)
+	if cfg.FeedsFile != "" {
+		fromFile, err := readFeedList(cfg.FeedsFile)
+		if err != nil {
+			return nil, err
+		}
+		feeds = append(feeds, fromFile...)
+	}
+	return feeds, nil
+}
+
+func seenPath() string {
+	return filepath.Join(newsbdlDir(), "seen")
+}
+
+// SeenSet is the set of feed item GUIDs already downloaded, persisted
+// across runs so a feed's backlog is only ever fetched once.
+type SeenSet struct {
+	Set
+	path string
+}
+
+func loadSeen(path string) (*SeenSet, error) {
+	seen := &SeenSet{Set: Set{}, path: path}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return seen, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		seen.Add(strings.TrimSpace(scan.Text()))
+	}
+	return seen, scan.Err()
+}
+
+func (s *SeenSet) save() error {
+	f, err := os.Create(s.path)
+	if err != nil {
+		return err
+	}
+	for guid := range s.Set {
+		fmt.Fprintln(f, guid)
+	}
+	return f.Close()
+}
+
+// markSeen records every successfully downloaded entry's GUID.
+func markSeen(seen *SeenSet, results Downloads) {
+	for _, dl := range results {
+		if dl.err == nil {
+			seen.Add(dl.entry)
+		}
+	}
+}
+
+// feedEntries fetches every feed concurrently, parses it, and turns each
+// unseen enclosure into a QueueEntry carrying the item's metadata.
+func feedEntries(feeds Feeds, seen *SeenSet) []*QueueEntry {
+	parser := gofeed.NewParser()
+	parser.Client = httpClient
+
+	type fetched struct {
+		feed *gofeed.Feed
+		url  string
+		err  error
+	}
+	fetches := make(chan fetched, len(feeds))
+	wg := &sync.WaitGroup{}
+	for _, feedURL := range feeds {
+		wg.Add(1)
+		go func(feedURL string) {
+			defer wg.Done()
+			feed, err := parser.ParseURL(feedURL)
+			fetches <- fetched{feed, feedURL, err}
+		}(feedURL)
+	}
+	go func() {
+		wg.Wait()
+		close(fetches)
+	}()
+
+	entries := []*QueueEntry{}
+	for f := range fetches {
+		if f.err != nil {
+			logging.Error("net", "feed error: %s: %v", f.url, f.err)
+			continue
+		}
+		entries = append(entries, feedItemEntries(f.feed, seen)...)
+	}
+	return entries
+}
+
+func feedItemEntries(feed *gofeed.Feed, seen *SeenSet) []*QueueEntry {
+	entries := []*QueueEntry{}
+	for _, item := range feed.Items {
+		guid := item.GUID
+		if guid == "" {
+			guid = item.Link
+		}
+		if guid == "" || seen.Has(guid) {
+			continue
+		}
+		var pubDate time.Time
+		if item.PublishedParsed != nil {
+			pubDate = *item.PublishedParsed
+		}
+		for _, enc := range item.Enclosures {
+			u, err := url.Parse(enc.URL)
+			if err != nil {
+				continue
+			}
+			entries = append(entries, &QueueEntry{
+				url:       u,
+				entry:     guid,
+				feedTitle: feed.Title,
+				itemTitle: item.Title,
+				pubDate:   pubDate,
+			})
+		}
+	}
+	return entries
+}
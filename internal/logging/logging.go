@@ -0,0 +1,82 @@
+// Package logging provides a small leveled logger gated by subsystem, in
+// the style of syncthing's logging package: Debug output for a subsystem
+// is only emitted when that subsystem is named in NEWSBDL_TRACE (a
+// comma-separated list, e.g. "net,fs,retry"; "*" enables everything).
+// Info/Warn/Error are always emitted.
+package logging
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type level int
+
+const (
+	levelDebug level = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+func (l level) String() string {
+	switch l {
+	case levelDebug:
+		return "DEBUG"
+	case levelInfo:
+		return "INFO"
+	case levelWarn:
+		return "WARN"
+	default:
+		return "ERROR"
+	}
+}
+
+var (
+	mu     sync.Mutex
+	traced = traceSubsystems(os.Getenv("NEWSBDL_TRACE"))
+)
+
+func traceSubsystems(env string) map[string]bool {
+	set := map[string]bool{}
+	for _, s := range strings.Split(env, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			set[s] = true
+		}
+	}
+	return set
+}
+
+// Traced reports whether debug output for subsystem is enabled.
+func Traced(subsystem string) bool {
+	return traced["*"] || traced[subsystem]
+}
+
+func logf(l level, subsystem, format string, args ...interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	fmt.Fprintf(os.Stderr, "%s %-5s %-6s %s\n",
+		time.Now().Format("15:04:05.000"), l, subsystem, fmt.Sprintf(format, args...))
+}
+
+// Debug logs to subsystem only when it's named in NEWSBDL_TRACE.
+func Debug(subsystem, format string, args ...interface{}) {
+	if Traced(subsystem) {
+		logf(levelDebug, subsystem, format, args...)
+	}
+}
+
+func Info(subsystem, format string, args ...interface{}) {
+	logf(levelInfo, subsystem, format, args...)
+}
+
+func Warn(subsystem, format string, args ...interface{}) {
+	logf(levelWarn, subsystem, format, args...)
+}
+
+func Error(subsystem, format string, args ...interface{}) {
+	logf(levelError, subsystem, format, args...)
+}
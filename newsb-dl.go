@@ -5,33 +5,62 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/aver-d/newsb-dl/internal/logging"
+)
+
+const (
+	defaultMaxAttempts = 5
+	backoffBase        = 500 * time.Millisecond
+	backoffCap         = 30 * time.Second
 )
 
-// Wrap default http.Get with timeout functionality
-var httpGet = func() func(string) (*http.Response, error) {
-	dial := &net.Dialer{Timeout: 20 * time.Second}
-	client := &http.Client{
-		Transport: &http.Transport{Dial: dial.Dial},
+// maxAttempts, httpClient and hashIndex are set up from Config in main
+// before any download starts; the initial values here only matter for
+// tests that call saveAudio directly.
+var (
+	maxAttempts = defaultMaxAttempts
+	httpClient  = newHTTPClient(20*time.Second, 20*time.Second)
+	hashIndex   = &HashIndex{paths: map[string]string{}}
+)
+
+// newHTTPClient mirrors the dial/TLS/response-header timeouts used by
+// imposm3's replication downloader, so a stuck server can't hang a worker
+// forever.
+func newHTTPClient(dialTimeout, requestTimeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Dial:                  (&net.Dialer{Timeout: dialTimeout}).Dial,
+			TLSHandshakeTimeout:   requestTimeout,
+			ResponseHeaderTimeout: requestTimeout,
+		},
 	}
-	return client.Get
-}()
+}
 
 type Download struct {
-	url       *url.URL
-	entry     string
-	dir       string
-	startedAt time.Time
-	data      io.ReadCloser
-	err       error
+	url          *url.URL
+	entry        string
+	dir          string
+	userAgent    string
+	feedTitle    string
+	itemTitle    string
+	pubDate      time.Time
+	startedAt    time.Time
+	bytesWritten int64
+	data         io.ReadCloser
+	err          error
 }
 
 type Downloads []*Download
@@ -43,52 +72,261 @@ func (d *Downloads) Push(dl *Download) {
 type QueueEntry struct {
 	url   *url.URL
 	entry string
+
+	// feedTitle, itemTitle and pubDate are set when the entry came from
+	// -feeds mode instead of readQueue, and let saveAudio name the file
+	// after the item rather than the URL.
+	feedTitle string
+	itemTitle string
+	pubDate   time.Time
 }
 
 func fail(err error) {
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s error: %v\n", os.Args[0], err)
+		logging.Error("main", "%v", err)
 		os.Exit(1)
 	}
 }
 
-func saveAudio(data io.Reader, dl *Download) error {
-
-	nextFile := func(path string) (io.WriteCloser, string, error) {
-		base := path
-		n := 1
-		for {
-			file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
-			if os.IsExist(err) {
-				path = fmt.Sprintf("%s.%d", base, n)
-				n += 1
-				continue
-			}
-			if err != nil {
-				return nil, "", err
-			}
-			return file, path, nil
-		}
+// renameUnique moves src onto the first free name starting at base,
+// the same collision handling saveAudio used to do for both its
+// temp and final paths, and returns the path it landed on. The name is
+// claimed with O_CREATE|O_EXCL before the rename so two downloads racing
+// on the same base name can't land on each other: os.Rename alone would
+// silently replace an existing destination.
+func renameUnique(src, base string) (string, error) {
+	f, path, err := claimName(base)
+	if err != nil {
+		return "", err
 	}
-	name := filepath.Base(dl.url.Path)
-	pathTemp := filepath.Join(dl.dir, name+".part")
-	pathData := filepath.Join(dl.dir, name)
+	f.Close()
+	logging.Debug("fs", "rename %s -> %s", src, path)
+	return path, os.Rename(src, path)
+}
+
+// backoff computes an exponential delay with jitter: min(cap, base*2^n) + rand.
+func backoff(attempt int) time.Duration {
+	d := backoffBase * time.Duration(uint64(1)<<uint(attempt-1))
+	if d > backoffCap {
+		d = backoffCap
+	}
+	return d + time.Duration(rand.Int63n(int64(backoffBase)))
+}
 
-	fileTemp, pathTemp, err := nextFile(pathTemp)
+// retryAfter parses a Retry-After header as either delay-seconds or an
+// HTTP-date, returning 0 if absent or unparsable.
+func retryAfter(r *http.Response) time.Duration {
+	v := r.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if when, err := http.ParseTime(v); err == nil {
+		return time.Until(when)
+	}
+	return 0
+}
+
+// permanentErr wraps a writeBody failure that retrying can never fix, such
+// as a response that isn't audio/video at all, so shouldRetry can tell it
+// apart from a transient network or body-read error.
+type permanentErr struct{ err error }
+
+func (e *permanentErr) Error() string { return e.err.Error() }
+func (e *permanentErr) Unwrap() error { return e.err }
+
+// shouldRetry reports whether a failed attempt is worth retrying: network
+// errors, 5xx, and 408/429 (honoring Retry-After) are retried; any other
+// 4xx or a permanentErr from writeBody is not. err is always non-nil here,
+// since saveAudio only calls this after a failed attempt.
+func shouldRetry(r *http.Response, err error) (retry bool, wait time.Duration) {
+	var perm *permanentErr
+	if errors.As(err, &perm) {
+		return false, 0
+	}
+	if r == nil {
+		// fetchRange failed before getting a response at all.
+		return true, 0
+	}
+	switch {
+	case r.StatusCode == http.StatusRequestTimeout, r.StatusCode == http.StatusTooManyRequests:
+		return true, retryAfter(r)
+	case r.StatusCode >= 500:
+		return true, retryAfter(r)
+	case r.StatusCode >= 400:
+		return false, 0
+	}
+	// A 2xx/3xx status with a non-nil, non-permanent error is a transient
+	// failure partway through the body (short read, sniff I/O error, ...).
+	return true, 0
+}
+
+func fetchRange(urlStr, userAgent string, start int64) (*http.Response, error) {
+	logging.Debug("net", "GET %s (start=%d)", urlStr, start)
+	req, err := http.NewRequest("GET", urlStr, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer fileTemp.Close()
-	fileData, pathData, err := nextFile(pathData)
+	if start > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+	}
+	if userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	return httpClient.Do(req)
+}
+
+// writeBody validates and copies a response body to pathTemp, publishing
+// progress events for dl as it goes, and returns the Content-Type
+// (sniffed if the header is missing) so saveAudio can correct a
+// URL-derived name that has no extension. It rejects anything that isn't
+// audio/* or video/*, and treats a short read against a declared
+// Content-Length as failure rather than success. Validation only runs on
+// a 200 response, keyed off r.StatusCode rather than the caller's start
+// offset: a host that ignores Range and answers the full body with 200
+// still needs checking, while a genuine 206 resume doesn't have the
+// start of the body to sniff.
+func writeBody(r *http.Response, pathTemp string, start int64, dl *Download, events chan<- Event) (string, error) {
+	if r.StatusCode != http.StatusOK && r.StatusCode != http.StatusPartialContent {
+		return "", fmt.Errorf("HTTP status: %v", r.Status)
+	}
+
+	var body io.Reader = r.Body
+	if r.ContentLength >= 0 {
+		body = io.LimitReader(body, r.ContentLength)
+	}
+
+	var contentType string
+	if r.StatusCode == http.StatusOK {
+		sniffed, rest, err := sniffMediaType(body)
+		if err != nil {
+			return "", err
+		}
+		contentType = r.Header.Get("Content-Type")
+		if !isMediaType(contentType) && !isMediaType(sniffed) {
+			return "", &permanentErr{fmt.Errorf("refusing non-media response: Content-Type %q, sniffed %q", contentType, sniffed)}
+		}
+		if contentType == "" {
+			contentType = sniffed
+		}
+		body = rest
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	if r.StatusCode == http.StatusPartialContent && start > 0 {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(pathTemp, flags, 0600)
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer fileData.Close()
-	_, err = io.Copy(fileTemp, data)
+	defer f.Close()
+
+	total := start + r.ContentLength
+	if r.ContentLength < 0 {
+		total = 0
+	}
+	counted := &countingReader{r: body, dl: dl, totalBytes: total, events: events}
+	n, err := io.Copy(f, counted)
 	if err != nil {
-		return err
+		return "", err
+	}
+	if r.ContentLength >= 0 && n != r.ContentLength {
+		return "", fmt.Errorf("short read: got %d bytes, expected %d", n, r.ContentLength)
+	}
+	return contentType, nil
+}
+
+var nonFilenameChars = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+
+// sanitizeTitle turns an arbitrary feed title into a short, filesystem-safe
+// token.
+func sanitizeTitle(title string) string {
+	s := strings.Trim(nonFilenameChars.ReplaceAllString(strings.TrimSpace(title), "-"), "-")
+	if s == "" {
+		s = "untitled"
+	}
+	if len(s) > 80 {
+		s = s[:80]
+	}
+	return s
+}
+
+// downloadName picks the file name for dl: <feed>/<YYYY-MM-DD>-<title><ext>
+// when it came from -feeds mode with an item title (without the <feed>/
+// directory if the feed has no title), or the URL's basename otherwise (the
+// URL path alone is useless for hosts that serve e.g. download.mp3?id=...).
+func downloadName(dl *Download) string {
+	if dl.itemTitle == "" {
+		return filepath.Base(dl.url.Path)
+	}
+	date := dl.pubDate
+	if date.IsZero() {
+		date = time.Now()
+	}
+	name := fmt.Sprintf("%s-%s%s", date.Format("2006-01-02"), sanitizeTitle(dl.itemTitle), filepath.Ext(dl.url.Path))
+	if dl.feedTitle == "" {
+		return name
+	}
+	return filepath.Join(sanitizeTitle(dl.feedTitle), name)
+}
+
+// saveAudio fetches dl.url into dl.dir, resuming from an existing .part
+// file and retrying transient failures with exponential backoff. Progress
+// events are sent to events if non-nil.
+func saveAudio(dl *Download, events chan<- Event) error {
+	name := downloadName(dl)
+	pathTemp := filepath.Join(dl.dir, name+".part")
+	pathData := filepath.Join(dl.dir, name)
+	if dir := filepath.Dir(pathData); dir != dl.dir {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	// maxAttempts is set from the user-editable Retries config field; even
+	// if it's somehow <= 0, a download must get at least one real try
+	// rather than being silently reported as done with nothing fetched.
+	attempts := maxAttempts
+	if attempts < 1 {
+		attempts = 1
 	}
-	return os.Rename(pathTemp, pathData)
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		var start int64
+		if fi, statErr := os.Stat(pathTemp); statErr == nil {
+			start = fi.Size()
+		}
+		dl.bytesWritten = start
+		var r *http.Response
+		r, err = fetchRange(dl.url.String(), dl.userAgent, start)
+		var contentType string
+		if err == nil {
+			contentType, err = writeBody(r, pathTemp, start, dl, events)
+			r.Body.Close()
+		}
+		if err == nil {
+			if ext := extensionFor(contentType); ext != "" && filepath.Ext(name) == "" {
+				pathData = filepath.Join(dl.dir, name+ext)
+			}
+			return finalizeDownload(pathTemp, pathData)
+		}
+		retry, wait := shouldRetry(r, err)
+		if !retry || attempt == attempts {
+			break
+		}
+		if wait <= 0 {
+			wait = backoff(attempt)
+		}
+		logging.Debug("retry", "%s attempt %d/%d failed (%v), retrying in %v", dl.url, attempt, attempts, err, wait)
+		time.Sleep(wait)
+	}
+	return err
 }
 
 func queuePath(program string) string {
@@ -112,26 +350,29 @@ func (set Set) Has(s string) bool {
 	return found
 }
 
-func downloadByHost(downloads []*Download, results chan *Download, wg *sync.WaitGroup) {
+// downloadByHost runs downloads for a single host, never exceeding
+// perHost concurrent requests to it, while also holding a slot in the
+// shared global semaphore.
+func downloadByHost(downloads Downloads, perHost, global chan struct{}, events chan Event, wg *sync.WaitGroup) {
 	for _, dl := range downloads {
-		dl.startedAt = time.Now()
-		r, err := httpGet(dl.url.String())
-		switch {
-		case err != nil:
-			dl.err = err
-		case r.StatusCode != http.StatusOK:
-			dl.err = errors.New(fmt.Sprintf("HTTP status: %v", r.Status))
-		default:
-			dl.err = saveAudio(r.Body, dl)
-		}
-		if r != nil {
-			r.Body.Close()
-		}
-		results <- dl
+		dl := dl
+		perHost <- struct{}{}
+		global <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-global }()
+			defer func() { <-perHost }()
+			dl.startedAt = time.Now()
+			dl.err = saveAudio(dl, events)
+			events <- Event{Kind: EventComplete, Download: dl}
+		}()
 	}
-	wg.Done()
 }
 
+// report prints the non-TTY, line-per-completion summary of dl to stdout.
+// This is user-facing output, not diagnostics, so it bypasses the
+// logging package (reserved for diagnostics on stderr) the same way the TTY
+// renderer's own completion line does.
 func report(dl *Download, n, total int) {
 	fmt.Printf("(%d/%d) %s\n", n, total, dl.url)
 	if dl.err == nil {
@@ -140,33 +381,40 @@ func report(dl *Download, n, total int) {
 	} else {
 		fmt.Printf("Error: %v\n", dl.err)
 	}
-	if n != total {
-		fmt.Println()
-	}
 }
 
-// Download all resources in url list
-// Max of one connection per host
-func downloadAll(entries []*QueueEntry, dir string) chan *Download {
+// downloadAll downloads every entry, honoring cfg's per-host and global
+// concurrency limits.
+func downloadAll(entries []*QueueEntry, cfg *Config) chan Event {
 	// group by host first
 	hosts := map[string]Downloads{}
 	for _, e := range entries {
 		host := hosts[e.url.Host]
-		host.Push(&Download{url: e.url, entry: e.entry, dir: dir})
+		host.Push(&Download{
+			url:       e.url,
+			entry:     e.entry,
+			dir:       cfg.DestDir,
+			userAgent: cfg.userAgent(e.url.Host),
+			feedTitle: e.feedTitle,
+			itemTitle: e.itemTitle,
+			pubDate:   e.pubDate,
+		})
 		hosts[e.url.Host] = host
 	}
 	wg := &sync.WaitGroup{}
-	results := make(chan *Download)
+	wg.Add(len(entries))
+	events := make(chan Event)
+	global := make(chan struct{}, cfg.GlobalConcurrency)
 
-	for _, list := range hosts {
-		wg.Add(1)
-		go downloadByHost(list, results, wg)
+	for host, list := range hosts {
+		perHost := make(chan struct{}, cfg.maxPerHost(host))
+		go downloadByHost(list, perHost, global, events, wg)
 	}
 	go func() {
 		wg.Wait()
-		close(results)
+		close(events)
 	}()
-	return results
+	return events
 }
 
 func mkdir(dir string) {
@@ -209,13 +457,23 @@ func rewriteQueue(path string, results Downloads) {
 	fail(f.Close())
 }
 
-func readQueue() ([]*QueueEntry, string) {
-	path := queuePath("newsboat")
-	f, err := os.Open(path)
-	if err != nil {
-		path = queuePath("newsbeuter")
+// readQueue reads newsboat's (or newsbeuter's) queue file, unless
+// override is set, in which case it is read verbatim.
+func readQueue(override string) ([]*QueueEntry, string) {
+	path := override
+	var f *os.File
+	var err error
+	if path != "" {
 		f, err = os.Open(path)
 		fail(err)
+	} else {
+		path = queuePath("newsboat")
+		f, err = os.Open(path)
+		if err != nil {
+			path = queuePath("newsbeuter")
+			f, err = os.Open(path)
+			fail(err)
+		}
 	}
 	defer f.Close()
 	scan := bufio.NewScanner(f)
@@ -230,7 +488,7 @@ func readQueue() ([]*QueueEntry, string) {
 		urlset.Add(urlstr)
 		u, err := url.Parse(urlstr)
 		fail(err)
-		entries = append(entries, &QueueEntry{u, line})
+		entries = append(entries, &QueueEntry{url: u, entry: line})
 	}
 	fail(scan.Err())
 	return entries, path
@@ -255,7 +513,7 @@ func log(results Downloads) {
 	}
 	f, err := openAppend(logPath())
 	if err != nil {
-		fmt.Println("Could not open log path:", logPath())
+		logging.Error("fs", "could not open log path %s: %v", logPath(), err)
 		return
 	}
 	for _, dl := range results {
@@ -268,7 +526,9 @@ func log(results Downloads) {
 }
 
 func usage(exitcode int) {
-	message := "Usage: newsb-dl <dir>"
+	message := "Usage: newsb-dl [-feeds] [dir]\n\n" +
+		"dir overrides dest_dir from ~/.config/newsb-dl/config.toml\n" +
+		"-feeds reads the feeds/feeds_file from config instead of the newsboat queue"
 	var stream = os.Stderr
 	if exitcode == 0 {
 		stream = os.Stdout
@@ -278,24 +538,54 @@ func usage(exitcode int) {
 }
 
 func main() {
-	var dir string
-	args := os.Args[1:]
+	var feedsMode bool
+	args := []string{}
+	for _, a := range os.Args[1:] {
+		if a == "-feeds" {
+			feedsMode = true
+			continue
+		}
+		args = append(args, a)
+	}
 	n := len(args)
-	switch {
-	case n == 1 && (args[0] == "--help" || args[0] == "-h"):
+	if n == 1 && (args[0] == "--help" || args[0] == "-h") {
 		usage(0)
-	case n == 1:
-		dir = args[0]
+	}
+	if n > 1 {
+		usage(1)
+	}
+
+	cfg, err := loadConfig(configPath())
+	fail(err)
+	if n == 1 {
+		dir := args[0]
 		stat, err := os.Stat(dir)
 		fail(err)
 		if !stat.IsDir() {
 			fail(fmt.Errorf("Not a directory: %s", dir))
 		}
-	default:
+		cfg.DestDir = dir
+	}
+	if cfg.DestDir == "" {
 		usage(1)
 	}
+	maxAttempts = cfg.Retries
+	httpClient = newHTTPClient(cfg.dialTimeout(), cfg.requestTimeout())
+	hashIndex, err = loadHashIndex(hashesPath())
+	fail(err)
 
-	entries, path := readQueue()
+	var entries []*QueueEntry
+	var queuePathVal string
+	var seen *SeenSet
+	if feedsMode {
+		feeds, err := resolveFeeds(cfg)
+		fail(err)
+		seen, err = loadSeen(seenPath())
+		fail(err)
+		entries = feedEntries(feeds, seen)
+	} else {
+		entries, queuePathVal = readQueue(cfg.QueuePath)
+	}
 	if len(entries) == 0 {
 		fmt.Println("Nothing queued")
 		return
@@ -303,15 +593,27 @@ func main() {
 	for _, entry := range entries {
 		fmt.Println("Queued:", entry.url)
 	}
-	fmt.Printf("Downloading to %v ...\n", dir)
+	fmt.Printf("Downloading to %v ...\n", cfg.DestDir)
 
 	results := []*Download{}
 	count := 1
-	for dl := range downloadAll(entries, dir) {
-		report(dl, count, len(entries))
-		results = append(results, dl)
-		count += 1
+	renderer := NewProgressRenderer(isTTY(os.Stdout))
+	for ev := range downloadAll(entries, cfg) {
+		switch ev.Kind {
+		case EventProgress:
+			renderer.Progress(ev)
+		case EventComplete:
+			renderer.Complete(ev.Download, count, len(entries))
+			results = append(results, ev.Download)
+			count += 1
+		}
+	}
+	if feedsMode {
+		markSeen(seen, results)
+		fail(seen.save())
+	} else {
+		rewriteQueue(queuePathVal, results)
 	}
-	rewriteQueue(path, results)
+	fail(hashIndex.save())
 	log(results)
 }
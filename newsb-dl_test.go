@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	for attempt := 1; attempt <= 8; attempt++ {
+		d := backoff(attempt)
+		want := backoffBase * time.Duration(uint64(1)<<uint(attempt-1))
+		if want > backoffCap {
+			want = backoffCap
+		}
+		if d < want || d >= want+backoffBase {
+			t.Errorf("backoff(%d) = %v, want in [%v, %v)", attempt, d, want, want+backoffBase)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+		want   time.Duration
+	}{
+		{"absent", "", 0},
+		{"unparsable", "soon", 0},
+		{"delay-seconds", "120", 120 * time.Second},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := &http.Response{Header: http.Header{}}
+			if c.header != "" {
+				r.Header.Set("Retry-After", c.header)
+			}
+			if got := retryAfter(r); got != c.want {
+				t.Errorf("retryAfter(%q) = %v, want %v", c.header, got, c.want)
+			}
+		})
+	}
+
+	t.Run("http-date", func(t *testing.T) {
+		when := time.Now().Add(90 * time.Second).UTC()
+		r := &http.Response{Header: http.Header{}}
+		r.Header.Set("Retry-After", when.Format(http.TimeFormat))
+		got := retryAfter(r)
+		if got <= 0 || got > 91*time.Second {
+			t.Errorf("retryAfter(HTTP-date) = %v, want roughly 90s", got)
+		}
+	})
+}
+
+func TestShouldRetry(t *testing.T) {
+	resp := func(status int) *http.Response {
+		return &http.Response{StatusCode: status, Header: http.Header{}}
+	}
+	cases := []struct {
+		name      string
+		r         *http.Response
+		err       error
+		wantRetry bool
+	}{
+		{"network error, no response", nil, errors.New("dial tcp: connection refused"), true},
+		{"permanent error wins over 200", resp(http.StatusOK), &permanentErr{errors.New("refusing non-media response")}, false},
+		{"transient error on 200", resp(http.StatusOK), errors.New("short read: got 1 bytes, expected 2"), true},
+		{"404 is permanent", resp(http.StatusNotFound), errors.New("HTTP status: 404 Not Found"), false},
+		{"408 is retried", resp(http.StatusRequestTimeout), errors.New("HTTP status: 408 Request Timeout"), true},
+		{"429 is retried", resp(http.StatusTooManyRequests), errors.New("HTTP status: 429 Too Many Requests"), true},
+		{"500 is retried", resp(http.StatusInternalServerError), errors.New("HTTP status: 500 Internal Server Error"), true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			retry, _ := shouldRetry(c.r, c.err)
+			if retry != c.wantRetry {
+				t.Errorf("shouldRetry(%v, %v) retry = %v, want %v", c.r, c.err, retry, c.wantRetry)
+			}
+		})
+	}
+}
+
+// TestSaveAudioMinimumOneAttempt guards against a maxAttempts of 0 (one
+// that bypassed loadConfig's clamping of retries) turning every download
+// into a silent no-op success.
+func TestSaveAudioMinimumOneAttempt(t *testing.T) {
+	origAttempts, origClient, origIndex := maxAttempts, httpClient, hashIndex
+	defer func() { maxAttempts, httpClient, hashIndex = origAttempts, origClient, origIndex }()
+
+	maxAttempts = 0
+	httpClient = newHTTPClient(5*time.Second, 5*time.Second)
+	hashIndex = &HashIndex{paths: map[string]string{}}
+
+	const body = "\xff\xfb\x90\x00" + "not really mp3 but long enough to sniff as audio/mpeg................"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/mpeg")
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL + "/episode.mp3")
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+	dir := t.TempDir()
+	dl := &Download{url: u, dir: dir}
+
+	if err := saveAudio(dl, nil); err != nil {
+		t.Fatalf("saveAudio with maxAttempts=0: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "episode.mp3"))
+	if err != nil {
+		t.Fatalf("downloaded file missing despite maxAttempts=0: %v", err)
+	}
+	if string(data) != body {
+		t.Errorf("downloaded content = %q, want %q", data, body)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// EventKind distinguishes the two kinds of value sent on the results
+// channel: a progress tick for a download still in flight, and the
+// terminal result of one that finished.
+type EventKind int
+
+const (
+	EventProgress EventKind = iota
+	EventComplete
+)
+
+// Event is the tagged union carried on downloadAll's results channel, so
+// the main loop can drive rendering without polling.
+type Event struct {
+	Kind       EventKind
+	Download   *Download
+	BytesRead  int64
+	TotalBytes int64
+}
+
+// progressInterval caps how often a single download emits a progress
+// event, so a fast local link doesn't flood the results channel.
+const progressInterval = 200 * time.Millisecond
+
+// countingReader wraps a response body, publishing progress events as it
+// is read. Sends are non-blocking: a renderer that falls behind just
+// misses a tick rather than stalling the download.
+type countingReader struct {
+	r          io.Reader
+	dl         *Download
+	read       int64
+	totalBytes int64
+	events     chan<- Event
+	last       time.Time
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += int64(n)
+	if c.events != nil && (err != nil || time.Since(c.last) >= progressInterval) {
+		c.last = time.Now()
+		select {
+		case c.events <- Event{Kind: EventProgress, Download: c.dl, BytesRead: c.dl.bytesWritten + c.read, TotalBytes: c.totalBytes}:
+		default:
+		}
+	}
+	return n, err
+}
+
+func isTTY(f *os.File) bool {
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeCharDevice != 0
+}
+
+// progressState is a renderer's view of one in-flight download.
+type progressState struct {
+	bytesRead  int64
+	totalBytes int64
+	startedAt  time.Time
+}
+
+// ProgressRenderer draws a multi-line progress display on a TTY, one line
+// per in-flight download (bytes, %, ETA, throughput) in the order each
+// first reported progress; lines are neither grouped nor labelled by host.
+// Otherwise it falls back to report's plain line-per-completion output.
+type ProgressRenderer struct {
+	tty    bool
+	mu     sync.Mutex
+	order  []*Download
+	active map[*Download]*progressState
+	drawn  int
+}
+
+func NewProgressRenderer(tty bool) *ProgressRenderer {
+	return &ProgressRenderer{tty: tty, active: map[*Download]*progressState{}}
+}
+
+func (p *ProgressRenderer) Progress(ev Event) {
+	if !p.tty {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st, ok := p.active[ev.Download]
+	if !ok {
+		st = &progressState{startedAt: ev.Download.startedAt}
+		p.active[ev.Download] = st
+		p.order = append(p.order, ev.Download)
+	}
+	st.bytesRead = ev.BytesRead
+	st.totalBytes = ev.TotalBytes
+	p.draw()
+}
+
+func (p *ProgressRenderer) Complete(dl *Download, n, total int) {
+	if !p.tty {
+		report(dl, n, total)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.active, dl)
+	for i, d := range p.order {
+		if d == dl {
+			p.order = append(p.order[:i], p.order[i+1:]...)
+			break
+		}
+	}
+	p.clear()
+	status := "Ok"
+	if dl.err != nil {
+		status = fmt.Sprintf("Error: %v", dl.err)
+	}
+	fmt.Printf("(%d/%d) %s: %s\n", n, total, dl.url, status)
+	p.draw()
+}
+
+// clear erases the lines drawn by the previous draw call.
+func (p *ProgressRenderer) clear() {
+	if p.drawn == 0 {
+		return
+	}
+	fmt.Printf("\x1b[%dA\x1b[J", p.drawn)
+	p.drawn = 0
+}
+
+func (p *ProgressRenderer) draw() {
+	p.clear()
+	for _, dl := range p.order {
+		st := p.active[dl]
+		fmt.Println(progressLine(dl, st))
+	}
+	p.drawn = len(p.order)
+}
+
+func progressLine(dl *Download, st *progressState) string {
+	elapsed := time.Since(st.startedAt).Seconds()
+	throughput := float64(st.bytesRead) / maxFloat(elapsed, 0.001)
+	if st.totalBytes <= 0 {
+		return fmt.Sprintf("%s  %s  %s/s", filepath.Base(dl.url.Path), humanBytes(st.bytesRead), humanBytes(int64(throughput)))
+	}
+	pct := 100 * float64(st.bytesRead) / float64(st.totalBytes)
+	remaining := float64(st.totalBytes-st.bytesRead) / maxFloat(throughput, 1)
+	return fmt.Sprintf("%s  %s/%s  %.0f%%  %s/s  ETA %s",
+		filepath.Base(dl.url.Path), humanBytes(st.bytesRead), humanBytes(st.totalBytes), pct,
+		humanBytes(int64(throughput)), time.Duration(remaining*float64(time.Second)).Round(time.Second))
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}